@@ -0,0 +1,514 @@
+// License: GPLv3 Copyright: 2022, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kitty/tools/cli"
+	"kitty/tools/tui/graphics"
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+	"kitty/tools/utils/shm"
+)
+
+type Options struct {
+	Place              string
+	ZIndex             string
+	Mirror             string
+	Background         string
+	Clear              bool
+	TransferMode       string
+	DetectSupport      bool
+	DetectionTimeout   float64
+	PrintWindowSize    bool
+	Hold               bool
+	UnicodePlaceholder bool
+	Passthrough        string
+	Timeout            float64
+	Engine             string
+	Loop               int
+	Speed              float64
+	NoAnimation        bool
+}
+
+func create_cmd(parent *cli.Command, run func(cmd *cli.Command, o *Options, args []string) (int, error)) *cli.Command {
+	cmd := parent.AddSubCommand(&cli.Command{
+		Name:             "icat",
+		ShortDescription: "Display images in the terminal",
+		HelpText:         "Display images in the terminal using the kitty graphics protocol.",
+		Run: func(cmd *cli.Command, args []string) (int, error) {
+			o := &Options{}
+			err := cmd.GetOptionValues(o)
+			if err != nil {
+				return 1, err
+			}
+			return run(cmd, o, args)
+		},
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--place",
+		Help: "Place the image at the specified position, in the form <width>x<height>@<left>x<top>",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--z-index", Default: "0",
+		Help: "Z-index at which to draw the image.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--mirror", Default: "none",
+		Choices: "none,horizontal,vertical,both",
+		Help:    "Flip the image horizontally/vertically/both.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--background", Default: "none",
+		Help: "Background color to draw under a transparent image.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--clear", Type: "bool-set",
+		Help: "Remove all images currently displayed on the screen.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--transfer-mode", Default: "detect",
+		Choices: "detect,file,memory,stream",
+		Help:    "The method used to transfer image data to the terminal.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--detect-support", Type: "bool-set",
+		Help: "Detect the transfer mode supported by the terminal and exit.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--detection-timeout", Default: "10",
+		Help: "Time (in seconds) to wait for a response from the terminal when detecting support.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--print-window-size", Type: "bool-set",
+		Help: "Print out the window size as <width>x<height> and quit.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--hold", Type: "bool-set",
+		Help: "Wait for a key press before exiting, after displaying the images.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--unicode-placeholder", Type: "bool-set",
+		Help: "Use the Unicode placeholder technique to display images, so that they survive being passed through a terminal multiplexer such as tmux or screen that does not understand the graphics protocol.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--passthrough", Default: "none",
+		Choices: "none,tmux",
+		Help:    "Wrap escape codes so they survive being passed through the named terminal multiplexer.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--timeout", Default: "10",
+		Help: "Time (in seconds) to wait for an image to download when given a URL.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--engine", Default: "auto",
+		Choices: "auto,stream,file,memory",
+		Help:    "Bypass terminal transfer mode detection and use the specified engine unconditionally. Useful to cut startup latency when icat is invoked repeatedly in a loop, such as over piped images.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--loop", Default: "0",
+		Help: "Number of times to loop an animated image. 0 means loop forever.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--speed", Default: "1",
+		Help: "Multiply the delay between frames of an animated image by this factor.",
+	})
+	cmd.Add(cli.OptionSpec{
+		Name: "--no-animation", Type: "bool-set",
+		Help: "Only show the first frame of animated images.",
+	})
+	return cmd
+}
+
+// input_kind says where an input_arg's image data comes from.
+type input_kind int
+
+const (
+	input_is_file input_kind = iota
+	input_is_url
+	input_is_stdin
+)
+
+// input_arg represents a single image source specified on the command line.
+type input_arg struct {
+	path string
+	kind input_kind
+}
+
+// image_data holds the result of decoding a single image source, ready for
+// transmission to the terminal. A static image is returned fully decoded in
+// img. An animated image (unless --no-animation is used) is instead decoded
+// frame-by-frame and handed off via frames, so that a large animation never
+// needs to be held fully in memory at once.
+type image_data struct {
+	source_name string
+	err         error
+
+	img    *images.ImageData
+	frames <-chan images.ImageFrame
+}
+
+func process_dirs(args ...string) (items []input_arg, err error) {
+	items = make([]input_arg, 0, len(args))
+	stdin_used := false
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://"):
+			items = append(items, input_arg{path: arg, kind: input_is_url})
+		case arg == "-":
+			if stdin_used {
+				return nil, fmt.Errorf("Can not read image data from STDIN more than once")
+			}
+			if opts.Hold {
+				return nil, fmt.Errorf("Cannot use --hold with an image read from STDIN as --hold also needs to read from STDIN")
+			}
+			stdin_used = true
+			items = append(items, input_arg{path: arg, kind: input_is_stdin})
+		default:
+			st, statErr := os.Stat(arg)
+			if statErr != nil {
+				items = append(items, input_arg{path: arg, kind: input_is_file})
+				continue
+			}
+			if st.IsDir() {
+				filepath_err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					if !info.IsDir() {
+						items = append(items, input_arg{path: path, kind: input_is_file})
+					}
+					return nil
+				})
+				if filepath_err != nil {
+					return nil, filepath_err
+				}
+			} else {
+				items = append(items, input_arg{path: arg, kind: input_is_file})
+			}
+		}
+	}
+	return
+}
+
+var http_client *http.Client
+var http_client_once sync.Once
+
+// get_http_client is called from run_worker, which on_initialize may start
+// as more than one goroutine, so the lazy init is guarded by a sync.Once
+// rather than a bare nil check.
+func get_http_client() *http.Client {
+	http_client_once.Do(func() {
+		http_client = &http.Client{Timeout: time.Duration(opts.Timeout * float64(time.Second))}
+	})
+	return http_client
+}
+
+// open_reader opens ia's source, following redirects for URLs (the decoder
+// sniffs the format from the magic bytes, same as for a local file), and
+// streams straight into the decode pipeline without a full buffer-to-disk
+// round trip.
+func open_reader(ia input_arg) (io.ReadCloser, error) {
+	switch ia.kind {
+	case input_is_url:
+		resp, err := get_http_client().Get(ia.path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to download: %s with error: %w", ia.path, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Failed to download: %s with HTTP status: %s", ia.path, resp.Status)
+		}
+		return resp.Body, nil
+	case input_is_stdin:
+		return os.Stdin, nil
+	default:
+		return os.Open(ia.path)
+	}
+}
+
+func run_worker() {
+	for keep_going.Load() {
+		ia, ok := <-files_channel
+		if !ok {
+			return
+		}
+		imgd := &image_data{source_name: ia.path}
+		r, err := open_reader(ia)
+		if err != nil {
+			imgd.err = err
+			output_channel <- imgd
+			continue
+		}
+		// DecodeSource takes ownership of r, closing it itself once the
+		// static image is fully read or, for an animated source, once the
+		// background goroutine feeding imgd.frames has sent its last frame.
+		imgd.img, imgd.frames, imgd.err = images.DecodeSource(r, opts.NoAnimation)
+		output_channel <- imgd
+	}
+}
+
+// apply_passthrough configures g so that the APC sequence it eventually
+// writes is wrapped for the multiplexer named by --passthrough, since
+// tmux/screen otherwise swallow APC codes meant for the terminal underneath.
+func apply_passthrough(g *graphics.GraphicsCommand) *graphics.GraphicsCommand {
+	switch opts.Passthrough {
+	case "tmux":
+		g.SetPassthrough(graphics.GRT_passthrough_tmux)
+	}
+	return g
+}
+
+func transmit_image(imgd *image_data) {
+	iid := next_image_id()
+	if imgd.frames != nil && !opts.UnicodePlaceholder {
+		transmit_animated_image(imgd, iid)
+		return
+	}
+	if imgd.img == nil {
+		// --unicode-placeholder asked for a single frame from a source
+		// that was decoded animation-first; take the first
+		// frame off the stream instead of re-decoding, then drain the rest
+		// in the background so the decode goroutine isn't left blocked
+		// trying to send frames nobody will read.
+		first, ok := <-imgd.frames
+		if !ok {
+			return
+		}
+		imgd.img = &images.ImageData{Width: first.Width, Height: first.Height, Pixels: first.Pixels}
+		go func(frames <-chan images.ImageFrame) {
+			for range frames {
+			}
+		}(imgd.frames)
+	}
+	g := &graphics.GraphicsCommand{}
+	g.SetImageId(iid)
+	g.SetAction(graphics.GRT_action_transmit)
+	if place != nil && !opts.UnicodePlaceholder {
+		g.SetAction(graphics.GRT_action_transmit_and_display)
+	}
+	if opts.UnicodePlaceholder {
+		g.SetUnicodePlaceholder(true)
+	}
+	g.SetFormat(graphics.GRT_format_rgba)
+	g.SetDataWidth(uint64(imgd.img.Width)).SetDataHeight(uint64(imgd.img.Height))
+	g.SetDataSize(uint64(len(imgd.img.Pixels)))
+	mode, payload, err := prepare_transmission(imgd.img.Pixels)
+	if err != nil {
+		imgd.err = err
+		print_error("Failed to transmit \x1b[31m%s\x1b[39m: %v\r\n", imgd.source_name, err)
+		return
+	}
+	g.SetTransmission(mode)
+	apply_passthrough(g).WriteWithPayloadToLoop(lp, payload)
+	if opts.UnicodePlaceholder {
+		write_unicode_placeholder(imgd, iid)
+	}
+}
+
+// transmit_animated_image uploads every frame of an animated source to the
+// single image id iid, using the graphics protocol's animation action codes
+// (a=t for the first frame, a=f for every frame after it, with the z= gap
+// field carrying that frame's delay) and lets the terminal loop playback
+// rather than transmitting only the first frame. It ranges over imgd.frames
+// until the decode goroutine closes it, which is what actually keeps
+// on_wakeup from calling quit_loop before the tail of the animation has
+// been uploaded: this call does not return until every frame is sent.
+func transmit_animated_image(imgd *image_data, iid uint32) {
+	frame_number := 0
+	for frame := range imgd.frames {
+		g := &graphics.GraphicsCommand{}
+		g.SetImageId(iid).SetFormat(graphics.GRT_format_rgba).SetTransmission(graphics.GRT_transmission_direct)
+		g.SetDataWidth(uint64(frame.Width)).SetDataHeight(uint64(frame.Height))
+		gap := frame_gap(frame.Delay)
+		if frame_number == 0 {
+			g.SetAction(graphics.GRT_action_transmit).SetGap(gap)
+		} else {
+			g.SetAction(graphics.GRT_action_frame).SetFrameNumber(uint32(frame_number + 1)).SetGap(gap)
+		}
+		apply_passthrough(g).WriteWithPayloadToLoop(lp, frame.Pixels)
+		frame_number++
+	}
+	if frame_number == 0 {
+		return
+	}
+	ac := &graphics.GraphicsCommand{}
+	ac.SetImageId(iid).SetAction(graphics.GRT_action_animate).SetLoopCount(uint32(opts.Loop))
+	apply_passthrough(ac).WriteWithPayloadToLoop(lp, nil)
+}
+
+// frame_gap converts a frame's decoded delay into the graphics protocol's
+// z= gap field (milliseconds), applying --speed.
+func frame_gap(delay time.Duration) int32 {
+	ms := float64(delay / time.Millisecond)
+	if opts.Speed > 0 {
+		ms *= opts.Speed
+	}
+	return int32(ms)
+}
+
+// choose_transmission picks direct/tempfile/shm transmission based on what
+// on_initialize found (or was told via --transfer-mode/--engine, or forced
+// to for --unicode-placeholder) the terminal supports.
+func choose_transmission() graphics.GRT_t {
+	switch {
+	case transfer_by_memory == supported:
+		return graphics.GRT_transmission_sharedmem
+	case transfer_by_file == supported:
+		return graphics.GRT_transmission_tempfile
+	default:
+		return graphics.GRT_transmission_direct
+	}
+}
+
+// prepare_transmission returns the transmission mode chosen by
+// choose_transmission together with the payload WriteWithPayloadToLoop
+// should actually send: the pixel data itself for direct transmission, or
+// the name of a temp file/shared memory segment it has just written the
+// pixel data into.
+func prepare_transmission(pixels []byte) (graphics.GRT_t, []byte, error) {
+	switch choose_transmission() {
+	case graphics.GRT_transmission_sharedmem:
+		sf, err := shm.CreateTemp("icat-", uint64(len(pixels)))
+		if err != nil {
+			return graphics.GRT_transmission_direct, pixels, nil
+		}
+		copy(sf.Slice(), pixels)
+		sf.Close()
+		shm_files_to_delete = append(shm_files_to_delete, sf)
+		return graphics.GRT_transmission_sharedmem, utils.UnsafeStringToBytes(sf.Name()), nil
+	case graphics.GRT_transmission_tempfile:
+		tf, err := graphics.CreateTempInRAM()
+		if err != nil {
+			return graphics.GRT_transmission_direct, pixels, nil
+		}
+		if _, err = tf.Write(pixels); err != nil {
+			tf.Close()
+			return graphics.GRT_transmission_direct, nil, fmt.Errorf("Failed to write image data to temp file with error: %w", err)
+		}
+		tf.Close()
+		temp_files_to_delete = append(temp_files_to_delete, tf.Name())
+		return graphics.GRT_transmission_tempfile, utils.UnsafeStringToBytes(tf.Name()), nil
+	default:
+		return graphics.GRT_transmission_direct, pixels, nil
+	}
+}
+
+var last_image_id uint32
+
+func next_image_id() uint32 {
+	last_image_id++
+	return last_image_id
+}
+
+// placeholder_char is U+10EEEE, the codepoint reserved by the Unicode
+// placeholder scheme for virtual image cells.
+const placeholder_char = rune(0x10EEEE)
+
+// diacritics is the rowcolumn-diacritics table from the Unicode placeholder
+// scheme in the graphics protocol spec: a fixed, non-contiguous list of
+// combining marks, indexed directly (0 -> U+0305, 1 -> U+030D, ...) to
+// encode a row, a column, or the high byte of an image id. These are the
+// exact code points the protocol defines, so index N here decodes to N in
+// any conformant terminal.
+var diacritics = []rune{
+	0x0305, 0x030D, 0x030E, 0x0310, 0x0312, 0x033D, 0x033E, 0x033F,
+	0x0346, 0x034A, 0x034B, 0x034C, 0x0350, 0x0351, 0x0352, 0x0357,
+	0x035B, 0x0363, 0x0364, 0x0365, 0x0366, 0x0367, 0x0368, 0x0369,
+	0x036A, 0x036B, 0x036C, 0x036D, 0x036E, 0x036F, 0x0483, 0x0484,
+	0x0485, 0x0486, 0x0487, 0x0592, 0x0593, 0x0594, 0x0595, 0x0596,
+	0x0597, 0x0598, 0x0599, 0x059C, 0x059D, 0x059E, 0x059F, 0x05A0,
+	0x05A1, 0x05A8, 0x05A9, 0x05AB, 0x05AC, 0x05AF, 0x05C4, 0x0610,
+	0x0611, 0x0612, 0x0613, 0x0614, 0x0615, 0x0616, 0x0617, 0x0657,
+	0x0658, 0x0659, 0x065A, 0x065B, 0x065D, 0x065E, 0x06D6, 0x06D7,
+	0x06D8, 0x06D9, 0x06DA, 0x06DB, 0x06DC, 0x06DF, 0x06E0, 0x06E1,
+	0x06E2, 0x06E4, 0x06E7, 0x06E8, 0x06EB, 0x06EC, 0x0730, 0x0732,
+	0x0733, 0x0735, 0x0736, 0x073A, 0x073D, 0x073F, 0x0740, 0x0741,
+	0x0742, 0x0743, 0x0744, 0x0745, 0x0746, 0x0747, 0x0748, 0x0749,
+	0x074A, 0x07EB, 0x07EC, 0x07ED, 0x07EE, 0x07EF, 0x07F0, 0x07F1,
+	0x07F3, 0x0816, 0x0817, 0x0818, 0x0819, 0x081B, 0x081C, 0x081D,
+	0x081E, 0x081F, 0x0820, 0x0821, 0x0822, 0x0823, 0x0825, 0x0826,
+	0x0827, 0x0829, 0x082A, 0x082B, 0x082C, 0x082D, 0x0951, 0x0953,
+	0x0954, 0x0F82, 0x0F83, 0x0F86, 0x0F87, 0x135D, 0x135E, 0x135F,
+	0x17DD, 0x193A, 0x1A17, 0x1A18, 0x1A75, 0x1A76, 0x1A77, 0x1A78,
+	0x1A79, 0x1A7A, 0x1A7B, 0x1A7C, 0x1B6B, 0x1B6D, 0x1B6E, 0x1B6F,
+	0x1B70, 0x1B71, 0x1B72, 0x1B73, 0x1CD0, 0x1CD1, 0x1CD2, 0x1CDA,
+	0x1CDB, 0x1CE0, 0x1DC0, 0x1DC1, 0x1DC3, 0x1DC4, 0x1DC5, 0x1DC6,
+	0x1DC7, 0x1DC8, 0x1DC9, 0x1DCB, 0x1DCC, 0x1DD1, 0x1DD2, 0x1DD3,
+	0x1DD4, 0x1DD5, 0x1DD6, 0x1DD7, 0x1DD8, 0x1DD9, 0x1DDA, 0x1DDB,
+	0x1DDC, 0x1DDD, 0x1DDE, 0x1DDF, 0x1DE0, 0x1DE1, 0x1DE2, 0x1DE3,
+	0x1DE4, 0x1DE5, 0x1DE6, 0x1DFE, 0x20D0, 0x20D1, 0x20D2, 0x20D3,
+	0x20D4, 0x20D5, 0x20D6, 0x20D7, 0x20DB, 0x20DC, 0x20E1, 0x20E7,
+	0x20E9, 0x20F0, 0x2CEF, 0x2CF0, 0x2CF1, 0x2DE0, 0x2DE1, 0x2DE2,
+	0x2DE3, 0x2DE4, 0x2DE5, 0x2DE6, 0x2DE7, 0x2DE8, 0x2DE9, 0x2DEA,
+	0x2DEB, 0x2DEC, 0x2DED, 0x2DEE, 0x2DEF, 0x2DF0, 0x2DF1, 0x2DF2,
+	0x2DF3, 0x2DF4, 0x2DF5, 0x2DF6, 0x2DF7, 0x2DF8, 0x2DF9, 0x2DFA,
+	0x2DFB, 0x2DFC, 0x2DFD, 0x2DFE, 0x2DFF, 0xA66F, 0xA674, 0xA675,
+	0xA676, 0xA677, 0xA678, 0xA679, 0xA67A, 0xA67B, 0xA67C, 0xA67D,
+	0xA69E, 0xA69F, 0xA6F0, 0xA6F1, 0xA8E0, 0xA8E1, 0xA8E2, 0xA8E3,
+	0xA8E4, 0xA8E5, 0xA8E6, 0xA8E7, 0xA8E8, 0xA8E9, 0xA8EA, 0xA8EB,
+	0xA8EC, 0xA8ED, 0xA8EE, 0xA8EF, 0xA8F0, 0xA8F1, 0xAAB0, 0xAAB2,
+	0xAAB3, 0xAAB7, 0xAAB8, 0xAABE, 0xAABF, 0xAAC1, 0xFE20, 0xFE21,
+	0xFE22, 0xFE23, 0xFE24, 0xFE25, 0xFE26, 0x10A0F, 0x10A38, 0x1D185,
+	0x1D186, 0x1D187, 0x1D188, 0x1D189, 0x1D1AA, 0x1D1AB, 0x1D1AC,
+	0x1D1AD, 0x1D242, 0x1D243, 0x1D244,
+}
+
+// diacritic_for returns the diacritic for index n, clamping to the last
+// entry rather than wrapping, since a value past the end of the table
+// cannot be represented by this scheme at all.
+func diacritic_for(n int) rune {
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(diacritics) {
+		n = len(diacritics) - 1
+	}
+	return diacritics[n]
+}
+
+// unicode_placeholder_grid_size returns the number of placeholder rows and
+// columns to emit for imgd, preferring an explicit --place and otherwise
+// deriving a size from the terminal's reported cell geometry.
+func unicode_placeholder_grid_size(imgd *image_data) (rows, cols int) {
+	if place != nil {
+		return place.height, place.width
+	}
+	cell_width, cell_height := screen_size.CellWidth, screen_size.CellHeight
+	if cell_width == 0 || cell_height == 0 {
+		return 1, 1
+	}
+	cols = utils.Max(1, imgd.img.Width/int(cell_width))
+	rows = utils.Max(1, imgd.img.Height/int(cell_height))
+	return
+}
+
+// write_unicode_placeholder emits a rows×cols block of U+10EEEE cells whose
+// 24-bit SGR foreground color encodes iid and whose diacritics encode each
+// cell's row and column, per the multiplexer pass-through placeholder
+// scheme used to get images through tmux/screen until they gain native
+// graphics-protocol support.
+func write_unicode_placeholder(imgd *image_data, iid uint32) {
+	rows, cols := unicode_placeholder_grid_size(imgd)
+	r, g, b := byte(iid>>16), byte(iid>>8), byte(iid)
+	id_high_byte := diacritic_for(int(iid >> 24))
+	for row := 0; row < rows; row++ {
+		lp.QueueWriteString(fmt.Sprintf("\x1b[38;2;%d;%d;%dm", r, g, b))
+		row_mark := diacritic_for(row)
+		for col := 0; col < cols; col++ {
+			lp.QueueWriteString(string(placeholder_char))
+			lp.QueueWriteString(string(row_mark))
+			lp.QueueWriteString(string(diacritic_for(col)))
+			lp.QueueWriteString(string(id_high_byte))
+		}
+		lp.QueueWriteString("\x1b[39m\r\n")
+	}
+}
@@ -159,7 +159,7 @@ func on_initialize() (string, error) {
 	if opts.Clear {
 		cc := &graphics.GraphicsCommand{}
 		cc.SetAction(graphics.GRT_action_delete).SetDelete(graphics.GRT_free_visible)
-		cc.WriteWithPayloadToLoop(lp, nil)
+		apply_passthrough(cc).WriteWithPayloadToLoop(lp, nil)
 	}
 	lp.AddTimer(time.Duration(opts.DetectionTimeout*float64(time.Second)), false, on_detect_timeout)
 	g := func(t graphics.GRT_t, payload string) uint32 {
@@ -167,7 +167,7 @@ func on_initialize() (string, error) {
 		g1 := &graphics.GraphicsCommand{}
 		g1.SetTransmission(t).SetAction(graphics.GRT_action_query).SetImageId(iid).SetDataWidth(1).SetDataHeight(1).SetFormat(
 			graphics.GRT_format_rgb).SetDataSize(uint64(len(payload)))
-		g1.WriteWithPayloadToLoop(lp, utils.UnsafeStringToBytes(payload))
+		apply_passthrough(g1).WriteWithPayloadToLoop(lp, utils.UnsafeStringToBytes(payload))
 		return iid
 	}
 	keep_going.Store(true)
@@ -178,7 +178,43 @@ func on_initialize() (string, error) {
 			go run_worker()
 		}
 	}
+	if opts.UnicodePlaceholder {
+		// The multiplexer swallows the terminal's protocol responses, so the
+		// usual direct/file/memory probe would just time out. Force a mode
+		// that does not depend on a response instead.
+		transfer_by_stream = supported
+		if transfer_by_file != unsupported {
+			transfer_by_file = supported
+		}
+		transfer_by_memory = unsupported
+		return "", on_query_finished()
+	}
+	if opts.Engine != "auto" {
+		// Bypass the \x1b[c detection dance entirely: a script piping many
+		// images through icat in a loop pays its startup latency on every
+		// invocation, so let it name the engine it already knows works.
+		transfer_by_stream = supported
+		switch opts.Engine {
+		case "file":
+			transfer_by_file = supported
+		case "memory":
+			transfer_by_file = supported
+			transfer_by_memory = supported
+		}
+		return "", on_query_finished()
+	}
 	if opts.TransferMode != "detect" {
+		// Honor the user's explicit choice instead of just skipping the
+		// probe: transmit_image picks its transmission mode from these
+		// same transfer_by_* variables regardless of how they got set.
+		transfer_by_stream = supported
+		switch opts.TransferMode {
+		case "file":
+			transfer_by_file = supported
+		case "memory":
+			transfer_by_file = supported
+			transfer_by_memory = supported
+		}
 		return "", nil
 	}
 